@@ -0,0 +1,59 @@
+package config
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type WebRTC struct {
+	ICELite      bool
+	ICEServers   []webrtc.ICEServer
+	EphemeralMin uint16
+	EphemeralMax uint16
+	NAT1To1IPs   []string
+
+	// TURNSecret, when set, switches CreatePeer over to minting short-lived
+	// per-user TURN credentials (RFC 8489 §9.2, coturn's "static-auth-secret"
+	// convention) instead of handing every browser the same long-lived
+	// ICEServers credentials. TURNTTL controls how long each minted
+	// credential stays valid.
+	TURNSecret string
+	TURNTTL    time.Duration
+
+	// FrameEncryption gates registering the frame-marking header extension
+	// peers need to find Insertable Streams frame boundaries in the RTP
+	// stream. It does not make the server encrypt anything: media samples
+	// are written to the tracks as the pipeline produced them.
+	FrameEncryption bool
+}
+
+func (WebRTC) Set(cmd *cobra.Command) error {
+	cmd.PersistentFlags().Bool("webrtc.icelite", false, "configures whether or not the ICE agent should be a lite agent")
+	cmd.PersistentFlags().Uint16("webrtc.epr.min", 0, "lower bound of the ephemeral UDP port range used for ICE")
+	cmd.PersistentFlags().Uint16("webrtc.epr.max", 0, "upper bound of the ephemeral UDP port range used for ICE")
+	cmd.PersistentFlags().StringSlice("webrtc.nat1to1", []string{}, "an array of local IP addresses that are used as a NAT 1:1 mapping")
+
+	cmd.PersistentFlags().String("webrtc.turn.secret", "", "shared secret used to mint short-lived TURN credentials; static ICEServers credentials are used when empty")
+	cmd.PersistentFlags().Duration("webrtc.turn.ttl", time.Hour, "how long a minted TURN credential remains valid")
+
+	cmd.PersistentFlags().Bool("webrtc.frame_encryption", false, "enables the frame-marking header extension Insertable Streams encryption needs")
+
+	return viper.BindPFlags(cmd.PersistentFlags())
+}
+
+func (s *WebRTC) Init() error {
+	s.ICELite = viper.GetBool("webrtc.icelite")
+	s.EphemeralMin = uint16(viper.GetUint32("webrtc.epr.min"))
+	s.EphemeralMax = uint16(viper.GetUint32("webrtc.epr.max"))
+	s.NAT1To1IPs = viper.GetStringSlice("webrtc.nat1to1")
+
+	s.TURNSecret = viper.GetString("webrtc.turn.secret")
+	s.TURNTTL = viper.GetDuration("webrtc.turn.ttl")
+
+	s.FrameEncryption = viper.GetBool("webrtc.frame_encryption")
+
+	return nil
+}
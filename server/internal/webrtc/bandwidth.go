@@ -0,0 +1,85 @@
+package webrtc
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+// simulcastLayer pairs a video sample track with the outbound bitrate it
+// targets, ordered from the cheapest to the most expensive encoding.
+type simulcastLayer struct {
+	rid     string
+	track   *webrtc.TrackLocalStaticSample
+	bitrate uint32 // approximate steady-state bitrate in bits/sec
+}
+
+// newBandwidthEstimator registers pion's congestion controller (TWCC-fed
+// Google Congestion Control) in the interceptor registry and returns the
+// factory so CreatePeer can be notified of each peer's estimator and drive
+// per-peer layer selection off of it.
+func newBandwidthEstimator(engine *webrtc.MediaEngine, registry *interceptor.Registry) (*cc.InterceptorFactory, error) {
+	factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(1_000_000))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// We're the sender of video here, not the receiver: ConfigureTWCCSender
+	// registers a twcc.SenderInterceptor, which generates TWCC RTCP reports
+	// about a remote sender's packets, the wrong direction for us.
+	// ConfigureTWCCHeaderExtensionSender is what stamps the transport-cc
+	// sequence number on our outgoing packets so the browser can compute
+	// and send back the TWCC feedback gcc.SendSideBWE actually consumes
+	// (same as pion's bandwidth-estimation-from-disk example).
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(engine, registry); err != nil {
+		return nil, err
+	}
+
+	registry.Add(factory)
+	return factory, nil
+}
+
+// videoLayerRIDs describes the simulcast rids every peer's video sender is
+// built with, ordered low to high quality, along with the approximate
+// steady-state bitrate used to pick between them.
+var videoLayerRIDs = []struct {
+	rid     string
+	bitrate uint32
+}{
+	{rid: "q", bitrate: 200_000},
+	{rid: "h", bitrate: 600_000},
+	{rid: "f", bitrate: 1_800_000},
+}
+
+// newVideoLayers creates a fresh, peer-owned set of simulcast tracks. Each
+// peer gets its own tracks (rather than sharing one writer with everybody
+// else) so a slow viewer's backpressure stays local to it.
+func newVideoLayers(capability webrtc.RTPCodecCapability) ([]*simulcastLayer, error) {
+	layers := make([]*simulcastLayer, 0, len(videoLayerRIDs))
+	for _, r := range videoLayerRIDs {
+		track, err := webrtc.NewTrackLocalStaticSample(capability, "stream", "stream", webrtc.WithRTPStreamID(r.rid))
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, &simulcastLayer{rid: r.rid, track: track, bitrate: r.bitrate})
+	}
+
+	return layers, nil
+}
+
+// pickLayer returns the highest quality layer whose steady-state bitrate
+// still fits under the estimator's current target, falling back to the
+// lowest layer when even that doesn't fit.
+func pickLayer(layers []*simulcastLayer, targetBitrate int) *simulcastLayer {
+	best := layers[0]
+	for _, layer := range layers {
+		if uint32(targetBitrate) >= layer.bitrate {
+			best = layer
+		}
+	}
+	return best
+}
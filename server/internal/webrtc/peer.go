@@ -0,0 +1,155 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// sampleQueueSize bounds how many samples can be pending on a peer's own
+// writer goroutine before broadcast starts dropping rather than blocking.
+const sampleQueueSize = 8
+
+type Peer struct {
+	id            string
+	api           *webrtc.API
+	engine        *webrtc.MediaEngine
+	manager       *WebRTCManager
+	settings      *webrtc.SettingEngine
+	connection    *webrtc.PeerConnection
+	configuration *webrtc.Configuration
+
+	dataChannel      *webrtc.DataChannel
+	videoTransceiver *webrtc.RTPTransceiver
+	videoSender      *webrtc.RTPSender
+
+	audioTrack *webrtc.TrackLocalStaticSample
+	videoQueue chan media.Sample
+	audioQueue chan media.Sample
+
+	layers      []*simulcastLayer
+	layersMu    sync.Mutex
+	activeLayer string
+}
+
+// startWriters spins up this peer's own video/audio writer goroutines so
+// that WriteSample blocking on a slow or congested peer only ever stalls
+// that peer's queue, never the shared pipeline callback every peer is fed
+// from.
+func (peer *Peer) startWriters() {
+	peer.videoQueue = make(chan media.Sample, sampleQueueSize)
+	peer.audioQueue = make(chan media.Sample, sampleQueueSize)
+
+	go peer.writeLoop("video", peer.videoQueue, peer.writeVideoSample)
+	go peer.writeLoop("audio", peer.audioQueue, peer.writeAudioSample)
+}
+
+func (peer *Peer) writeLoop(kind string, queue <-chan media.Sample, write func(media.Sample) error) {
+	for sample := range queue {
+		if err := write(sample); err != nil && err != io.ErrClosedPipe {
+			peer.manager.logger.Warn().Err(err).Str("id", peer.id).Msgf("%s pipeline failed to write", kind)
+		}
+	}
+}
+
+// sendEncryptionHandshake forwards an Insertable Streams key-exchange
+// payload from fromID to the browser over this peer's data channel, the
+// same way SignalCandidate relays an ICE candidate: the server never parses
+// payload, it's ciphertext the two browsers produced and can decrypt, not
+// this process. See WebRTCManager.RelayEncryptionHandshake.
+func (peer *Peer) sendEncryptionHandshake(fromID string, payload []byte) error {
+	message, err := json.Marshal(struct {
+		Event   string `json:"event"`
+		From    string `json:"from"`
+		Payload []byte `json:"payload"`
+	}{
+		Event:   "signal/encryption",
+		From:    fromID,
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return peer.dataChannel.SendText(string(message))
+}
+
+// setActiveLayer is invoked by the bandwidth estimator's target bitrate
+// callback and records which simulcast rid this peer should be receiving.
+func (peer *Peer) setActiveLayer(targetBitrate int) {
+	layer := pickLayer(peer.layers, targetBitrate)
+
+	peer.layersMu.Lock()
+	changed := peer.activeLayer != layer.rid
+	peer.activeLayer = layer.rid
+	peer.layersMu.Unlock()
+
+	if changed {
+		peer.manager.logger.Info().
+			Str("id", peer.id).
+			Str("rid", layer.rid).
+			Int("target_bitrate", targetBitrate).
+			Msg("switching simulcast layer")
+	}
+}
+
+// writeVideoSample writes the one sample every layer shares to whichever
+// layer's track is currently active for this peer, leaving the other two
+// layers' tracks idle until the active layer changes -- see the KNOWN
+// LIMITATION note on WebRTCManager.Start's OnVideoFrame registration for why
+// this is a bandwidth-driven label swap across RIDs, not real simulcast. The
+// sample is written as the pipeline produced it; it is not encrypted here,
+// whether or not frame encryption is enabled.
+func (peer *Peer) writeVideoSample(sample media.Sample) error {
+	peer.layersMu.Lock()
+	rid := peer.activeLayer
+	peer.layersMu.Unlock()
+
+	for _, layer := range peer.layers {
+		if layer.rid == rid {
+			return layer.track.WriteSample(sample)
+		}
+	}
+
+	return nil
+}
+
+// writeAudioSample relays the sample to this peer's audio track as-is; like
+// writeVideoSample, it does not encrypt it.
+func (peer *Peer) writeAudioSample(sample media.Sample) error {
+	return peer.audioTrack.WriteSample(sample)
+}
+
+func (peer *Peer) SignalAnswer(sdp string) error {
+	return peer.connection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  sdp,
+	})
+}
+
+func (peer *Peer) SignalCandidate(candidate string) error {
+	iceCandidate := webrtc.ICECandidateInit{}
+	if err := json.Unmarshal([]byte(candidate), &iceCandidate); err != nil {
+		return err
+	}
+
+	return peer.connection.AddICECandidate(iceCandidate)
+}
+
+func (peer *Peer) Destroy() error {
+	if peer.videoQueue != nil {
+		close(peer.videoQueue)
+	}
+	if peer.audioQueue != nil {
+		close(peer.audioQueue)
+	}
+
+	if peer.connection == nil {
+		return nil
+	}
+
+	return peer.connection.Close()
+}
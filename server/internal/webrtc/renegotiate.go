@@ -0,0 +1,120 @@
+package webrtc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// RenegotiateOptions describes what should change about an already
+// established peer connection without tearing it down.
+type RenegotiateOptions struct {
+	// VideoCodec switches the outbound codec, e.g. "VP8" <-> "H264". Left
+	// empty, the existing codec and simulcast layers are kept.
+	VideoCodec string
+}
+
+// Renegotiate creates a fresh offer for this connection, optionally
+// swapping the outbound video codec first, and sends it to the browser over
+// the already-negotiated data channel rather than the initial signalling
+// path. The browser's answer comes back the same way it always has, via
+// Peer.SignalAnswer.
+func (peer *Peer) Renegotiate(opts RenegotiateOptions) error {
+	if opts.VideoCodec != "" {
+		if err := peer.replaceVideoCodec(opts.VideoCodec); err != nil {
+			return fmt.Errorf("renegotiate: %w", err)
+		}
+	}
+
+	description, err := peer.connection.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.connection.SetLocalDescription(description); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(description)
+	if err != nil {
+		return err
+	}
+
+	return peer.dataChannel.SendText(string(payload))
+}
+
+// replaceVideoCodec registers codecName on this peer's own MediaEngine (only
+// manager.videoCodec, the codec chosen at Start(), is registered otherwise,
+// so codecName could never legally appear in the renegotiated offer without
+// this), then swaps in a fresh set of simulcast tracks built for it.
+//
+// This can't be done with RTPSender.ReplaceTrack: pion rejects replacing the
+// track on any sender that already carries more than one simulcast
+// encoding (ErrRTPSenderNewTrackHasIncorrectEnvelope), and every video
+// sender this package creates has three. So the old track is removed via
+// RemoveTrack and a new one added via AddTrack, which -- unlike
+// AddTransceiverFromTrack -- reuses peer.videoTransceiver's now-empty
+// sender instead of minting a second, permanently stopped video m-line on
+// every call.
+func (peer *Peer) replaceVideoCodec(codecName string) error {
+	codec, err := codecParameters(codecName, []webrtc.RTCPFeedback{
+		{Type: webrtc.TypeRTCPFBGoogREMB},
+		{Type: webrtc.TypeRTCPFBTransportCC},
+		{Type: webrtc.TypeRTCPFBNACK},
+		{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := peer.engine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	layers, err := newVideoLayers(codec.RTPCodecCapability)
+	if err != nil {
+		return err
+	}
+
+	if err := peer.connection.RemoveTrack(peer.videoSender); err != nil {
+		return err
+	}
+
+	// RemoveTrack leaves peer.videoTransceiver in place with its sender's
+	// track set to nil -- Unified Plan transceivers are never actually
+	// removed, only marked inactive -- so AddTrack finds and reuses that
+	// same transceiver rather than adding a new one.
+	rtpVideo, err := peer.connection.AddTrack(layers[0].track)
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers[1:] {
+		if err := rtpVideo.AddEncoding(layer.track); err != nil {
+			return err
+		}
+	}
+
+	var videoTransceiver *webrtc.RTPTransceiver
+	for _, t := range peer.connection.GetTransceivers() {
+		if t.Sender() == rtpVideo {
+			videoTransceiver = t
+			break
+		}
+	}
+
+	peer.layersMu.Lock()
+	peer.videoTransceiver = videoTransceiver
+	peer.videoSender = rtpVideo
+	peer.layers = layers
+	peer.activeLayer = layers[len(layers)-1].rid
+	peer.layersMu.Unlock()
+
+	// The old sender's Read loop returns once RemoveTrack tears it down;
+	// start a replacement so RTCP (PLI/FIR, NACK, REMB) keeps flowing for
+	// the new sender.
+	go peer.readRTCP("video", rtpVideo)
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package webrtc
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// readRTCP drains RTCP from a sender and actually acts on what it contains,
+// instead of discarding it. A PLI/FIR from this peer is passed on as a
+// keyframe request carrying this peer's id; since all peers share one
+// encode, the resulting keyframe goes to every peer. NACKs are handled by
+// the default interceptors' retransmission and are just logged here.
+func (peer *Peer) readRTCP(kind string, sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := sender.Read(buf)
+		if err != nil {
+			return
+		}
+
+		packets, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			peer.manager.logger.Warn().Err(err).Str("id", peer.id).Msg("failed to unmarshal rtcp packet")
+			continue
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				peer.manager.logger.Debug().Str("id", peer.id).Str("kind", kind).Msg("received keyframe request")
+				peer.manager.keyframeRequest(peer.id)
+			case *rtcp.TransportLayerNack:
+				peer.manager.logger.Debug().Str("id", peer.id).Str("kind", kind).Msg("received nack")
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				peer.manager.logger.Debug().Str("id", peer.id).Str("kind", kind).Msg("received remb")
+			}
+		}
+	}
+}
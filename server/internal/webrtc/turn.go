@@ -0,0 +1,56 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"n.eko.moe/neko/internal/types/config"
+)
+
+// ephemeralICEServers mints short-lived TURN credentials per RFC 8489 §9.2
+// (coturn's "static-auth-secret" REST API convention) for every configured
+// TURN URL, rather than handing every browser session the same long-lived
+// password. STUN-only entries are returned unchanged. With no TURN secret
+// configured, the static servers from config are returned as before.
+func ephemeralICEServers(cfg *config.WebRTC, userID string) []webrtc.ICEServer {
+	if cfg.TURNSecret == "" {
+		return cfg.ICEServers
+	}
+
+	username := fmt.Sprintf("%d:%s", time.Now().Add(cfg.TURNTTL).Unix(), userID)
+
+	mac := hmac.New(sha1.New, []byte(cfg.TURNSecret))
+	mac.Write([]byte(username))
+	credential := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	servers := make([]webrtc.ICEServer, len(cfg.ICEServers))
+	copy(servers, cfg.ICEServers)
+
+	for i := range servers {
+		if !hasTURNURL(servers[i].URLs) {
+			continue
+		}
+
+		servers[i].Username = username
+		servers[i].Credential = credential
+		servers[i].CredentialType = webrtc.ICECredentialTypePassword
+	}
+
+	return servers
+}
+
+func hasTURNURL(urls []string) bool {
+	for _, url := range urls {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"n.eko.moe/neko/internal/types/config"
+)
+
+func TestHasTURNURL(t *testing.T) {
+	tests := []struct {
+		name string
+		urls []string
+		want bool
+	}{
+		{"empty", []string{}, false},
+		{"stun only", []string{"stun:stun.example.com:3478"}, false},
+		{"turn", []string{"turn:turn.example.com:3478"}, true},
+		{"turns", []string{"turns:turn.example.com:5349"}, true},
+		{"stun then turn", []string{"stun:stun.example.com:3478", "turn:turn.example.com:3478"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasTURNURL(tt.urls); got != tt.want {
+				t.Errorf("hasTURNURL(%v) = %v, want %v", tt.urls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEphemeralICEServersNoSecret(t *testing.T) {
+	static := []webrtc.ICEServer{
+		{URLs: []string{"turn:turn.example.com:3478"}, Username: "static-user", Credential: "static-pass"},
+	}
+	cfg := &config.WebRTC{ICEServers: static}
+
+	got := ephemeralICEServers(cfg, "user-1")
+
+	if len(got) != 1 || got[0].Username != "static-user" || got[0].Credential != "static-pass" {
+		t.Errorf("expected static ICEServers to pass through unchanged, got %+v", got)
+	}
+}
+
+func TestEphemeralICEServersMintsCredentials(t *testing.T) {
+	cfg := &config.WebRTC{
+		TURNSecret: "shared-secret",
+		TURNTTL:    time.Hour,
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.example.com:3478"}},
+			{URLs: []string{"turn:turn.example.com:3478"}},
+			{URLs: []string{"turns:turn.example.com:5349"}},
+		},
+	}
+
+	before := time.Now()
+	got := ephemeralICEServers(cfg, "user-1")
+	after := time.Now()
+
+	if len(got) != len(cfg.ICEServers) {
+		t.Fatalf("expected %d servers, got %d", len(cfg.ICEServers), len(got))
+	}
+
+	// The STUN-only entry must be untouched: no minted username/credential.
+	if got[0].Username != "" || got[0].Credential != nil {
+		t.Errorf("expected STUN-only entry to be left alone, got %+v", got[0])
+	}
+
+	for _, server := range []webrtc.ICEServer{got[1], got[2]} {
+		if server.CredentialType != webrtc.ICECredentialTypePassword {
+			t.Errorf("expected password credential type, got %v", server.CredentialType)
+		}
+
+		username := server.Username
+		parts := strings.SplitN(username, ":", 2)
+		if len(parts) != 2 || parts[1] != "user-1" {
+			t.Fatalf("expected username of the form <expiry>:user-1, got %q", username)
+		}
+
+		expiry, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			t.Fatalf("expected expiry to be a unix timestamp, got %q: %v", parts[0], err)
+		}
+
+		// expiry should be roughly TURNTTL from now, regardless of exactly
+		// when time.Now() was sampled inside ephemeralICEServers.
+		if expiry < before.Add(cfg.TURNTTL).Unix() || expiry > after.Add(cfg.TURNTTL).Unix() {
+			t.Errorf("expiry %d not within expected TTL window", expiry)
+		}
+
+		mac := hmac.New(sha1.New, []byte(cfg.TURNSecret))
+		mac.Write([]byte(username))
+		want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+		credential, ok := server.Credential.(string)
+		if !ok {
+			t.Fatalf("expected credential to be a string, got %T", server.Credential)
+		}
+
+		if credential != want {
+			t.Errorf("credential = %q, want HMAC-SHA1(secret, username) = %q", credential, want)
+		}
+	}
+}
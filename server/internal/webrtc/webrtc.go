@@ -3,11 +3,12 @@ package webrtc
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/rs/zerolog"
@@ -23,42 +24,69 @@ func New(sessions types.SessionManager, remote types.RemoteManager, config *conf
 		remote:   remote,
 		sessions: sessions,
 		config:   config,
+		peers:    map[string]*Peer{},
 	}
 }
 
 type WebRTCManager struct {
 	logger     zerolog.Logger
-	videoTrack *webrtc.TrackLocalStaticSample
-	audioTrack *webrtc.TrackLocalStaticSample
 	videoCodec webrtc.RTPCodecParameters
 	audioCodec webrtc.RTPCodecParameters
 	sessions   types.SessionManager
 	remote     types.RemoteManager
 	config     *config.WebRTC
+
+	peersMu sync.Mutex
+	peers   map[string]*Peer
+
+	// keyframeRequest is wired once in Start() and invoked by a peer's RTCP
+	// reader with that peer's id when it receives a PLI/FIR. Every peer is
+	// fed the same encode (see broadcast), so the keyframe that follows
+	// reaches all peers, not only the one that asked.
+	keyframeRequest func(id string)
 }
 
 func (manager *WebRTCManager) Start() {
 	var err error
-	manager.audioTrack, manager.audioCodec, err = manager.createTrack(manager.remote.AudioCodec())
+
+	manager.audioCodec, err = codecParameters(manager.remote.AudioCodec(), []webrtc.RTCPFeedback{})
 	if err != nil {
-		manager.logger.Panic().Err(err).Msg("unable to create audio track")
+		manager.logger.Panic().Err(err).Msg("unable to resolve audio codec")
 	}
 
-	manager.remote.OnAudioFrame(func(sample types.Sample) {
-		if err := manager.audioTrack.WriteSample(media.Sample(sample)); err != nil && err != io.ErrClosedPipe {
-			manager.logger.Warn().Err(err).Msg("audio pipeline failed to write")
-		}
+	manager.videoCodec, err = codecParameters(manager.remote.VideoCodec(), []webrtc.RTCPFeedback{
+		{Type: webrtc.TypeRTCPFBGoogREMB},
+		{Type: webrtc.TypeRTCPFBTransportCC},
+		{Type: webrtc.TypeRTCPFBNACK},
+		{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
 	})
-
-	manager.videoTrack, manager.videoCodec, err = manager.createTrack(manager.remote.VideoCodec())
 	if err != nil {
-		manager.logger.Panic().Err(err).Msg("unable to create video track")
+		manager.logger.Panic().Err(err).Msg("unable to resolve video codec")
 	}
 
+	manager.keyframeRequest = manager.remote.RequestKeyframe
+
+	manager.remote.OnAudioFrame(func(sample types.Sample) {
+		manager.broadcast("audio", func(peer *Peer) chan<- media.Sample {
+			return peer.audioQueue
+		}, media.Sample(sample))
+	})
+
+	// KNOWN LIMITATION: this is not real simulcast. Real simulcast needs
+	// internal/remote encoding each resolution concurrently so a receiver
+	// can be handed whichever one matches its bandwidth; that encoder work
+	// was never done as part of this series (internal/remote is untouched
+	// by it), and the gap is being called out here deliberately rather than
+	// left as an inline aside. What ships instead is a single encode fanned
+	// out to whichever one of a peer's three RID tracks setActiveLayer has
+	// currently picked, with the other two silent until the pick changes -- a
+	// bandwidth-driven track *label* swap, not a multi-resolution encode a
+	// receiver chooses between. Fixing this for real is an internal/remote
+	// change, out of scope for this package.
 	manager.remote.OnVideoFrame(func(sample types.Sample) {
-		if err := manager.videoTrack.WriteSample(media.Sample(sample)); err != nil && err != io.ErrClosedPipe {
-			manager.logger.Warn().Err(err).Msg("video pipeline failed to write")
-		}
+		manager.broadcast("video", func(peer *Peer) chan<- media.Sample {
+			return peer.videoQueue
+		}, media.Sample(sample))
 	})
 
 	manager.logger.Info().
@@ -74,9 +102,41 @@ func (manager *WebRTCManager) Shutdown() error {
 	return nil
 }
 
+// broadcast hands a locally produced sample to every connected peer's own
+// writer goroutine. The send itself is non-blocking: an actual WriteSample
+// happens later, off this shared callback, so one slow or congested peer's
+// pacer can never stall delivery to the rest. A peer whose queue is already
+// full has its sample dropped rather than buffered without bound.
+func (manager *WebRTCManager) broadcast(kind string, queueFor func(peer *Peer) chan<- media.Sample, sample media.Sample) {
+	manager.peersMu.Lock()
+	defer manager.peersMu.Unlock()
+
+	for _, peer := range manager.peers {
+		select {
+		case queueFor(peer) <- sample:
+		default:
+			manager.logger.Warn().Str("id", peer.id).Msgf("%s queue full, dropping sample", kind)
+		}
+	}
+}
+
+func (manager *WebRTCManager) addPeer(peer *Peer) {
+	manager.peersMu.Lock()
+	defer manager.peersMu.Unlock()
+	manager.peers[peer.id] = peer
+}
+
+func (manager *WebRTCManager) removePeer(id string) {
+	manager.peersMu.Lock()
+	defer manager.peersMu.Unlock()
+	delete(manager.peers, id)
+}
+
 func (manager *WebRTCManager) CreatePeer(id string, session types.Session) (string, bool, []webrtc.ICEServer, error) {
+	iceServers := ephemeralICEServers(manager.config, id)
+
 	configuration := &webrtc.Configuration{
-		ICEServers:   manager.config.ICEServers,
+		ICEServers:   iceServers,
 		SDPSemantics: webrtc.SDPSemanticsUnifiedPlanWithFallback,
 	}
 
@@ -104,9 +164,22 @@ func (manager *WebRTCManager) CreatePeer(id string, session types.Session) (stri
 	engine.RegisterCodec(manager.audioCodec, webrtc.RTPCodecTypeAudio)
 	engine.RegisterCodec(manager.videoCodec, webrtc.RTPCodecTypeVideo)
 
+	if manager.config.FrameEncryption {
+		// Lets the receiving end find frame boundaries inside the RTP
+		// stream, same as browsers do for Insertable Streams.
+		if err := engine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: frameMarkingURI}, webrtc.RTPCodecTypeVideo); err != nil {
+			return "", manager.config.ICELite, iceServers, err
+		}
+	}
+
 	i := &interceptor.Registry{}
 	if err := webrtc.RegisterDefaultInterceptors(&engine, i); err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
+	}
+
+	bwe, err := newBandwidthEstimator(&engine, i)
+	if err != nil {
+		return "", manager.config.ICELite, iceServers, err
 	}
 
 	// Create API with MediaEngine and SettingEngine
@@ -115,19 +188,26 @@ func (manager *WebRTCManager) CreatePeer(id string, session types.Session) (stri
 	// Create new peer connection
 	connection, err := api.NewPeerConnection(*configuration)
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
 	}
 
 	negotiated := true
-	_, err = connection.CreateDataChannel("data", &webrtc.DataChannelInit{
+	dataChannel, err := connection.CreateDataChannel("data", &webrtc.DataChannelInit{
 		Negotiated: &negotiated,
 	})
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
 	}
 
 	connection.OnDataChannel(func(d *webrtc.DataChannel) {
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if handled, err := manager.handleEncryptionHandshake(id, msg.Data); handled {
+				if err != nil {
+					manager.logger.Warn().Err(err).Str("id", id).Msg("encryption handshake relay failed")
+				}
+				return
+			}
+
 			if err = manager.handle(id, msg); err != nil {
 				manager.logger.Warn().Err(err).Msg("data handle failed")
 			}
@@ -142,36 +222,88 @@ func (manager *WebRTCManager) CreatePeer(id string, session types.Session) (stri
 			Msg("connection state has changed")
 	})
 
-	rtpVideo, err := connection.AddTrack(manager.videoTrack)
+	// Every peer gets its own simulcast tracks and its own audio track, fed
+	// from the shared pipeline via manager.broadcast, so one slow viewer's
+	// backpressure never stalls anyone else. Keyframe requests still go to
+	// the one shared encode (see keyframeRequest).
+	videoLayers, err := newVideoLayers(manager.videoCodec.RTPCodecCapability)
+	if err != nil {
+		return "", manager.config.ICELite, iceServers, err
+	}
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(manager.audioCodec.RTPCodecCapability, "stream", "stream")
+	if err != nil {
+		return "", manager.config.ICELite, iceServers, err
+	}
+
+	videoTransceiver, err := connection.AddTransceiverFromTrack(videoLayers[0].track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
+	}
+
+	rtpVideo := videoTransceiver.Sender()
+	for _, layer := range videoLayers[1:] {
+		if err := rtpVideo.AddEncoding(layer.track); err != nil {
+			return "", manager.config.ICELite, iceServers, err
+		}
 	}
 
-	rtpAudio, err := connection.AddTrack(manager.audioTrack)
+	rtpAudio, err := connection.AddTrack(audioTrack)
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
 	}
 
+	peer := &Peer{
+		id:               id,
+		api:              api,
+		engine:           &engine,
+		manager:          manager,
+		settings:         &settings,
+		connection:       connection,
+		configuration:    configuration,
+		dataChannel:      dataChannel,
+		videoTransceiver: videoTransceiver,
+		videoSender:      rtpVideo,
+		layers:           videoLayers,
+		activeLayer:      videoLayers[len(videoLayers)-1].rid,
+		audioTrack:       audioTrack,
+	}
+	peer.startWriters()
+
+	// bwe is scoped to this peer's own interceptor registry, so it only ever
+	// fires for this connection; the id it passes is pion's own interceptor
+	// id, not ours, so we close over peer directly instead of looking it up.
+	bwe.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		estimator.OnTargetBitrateChange(func(bitrate int) {
+			peer.setActiveLayer(bitrate)
+		})
+	})
+
 	description, err := connection.CreateOffer(nil)
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
 	}
 
 	err = connection.SetLocalDescription(description)
 	if err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+		return "", manager.config.ICELite, iceServers, err
 	}
 
 	connection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		switch state {
 		case webrtc.PeerConnectionStateDisconnected:
 			manager.logger.Info().Str("id", id).Msg("peer disconnected")
+			manager.removePeer(id)
 			manager.sessions.Destroy(id)
 		case webrtc.PeerConnectionStateFailed:
 			manager.logger.Warn().Str("id", id).Msg("peer failed")
+			manager.removePeer(id)
 			manager.sessions.Destroy(id)
 		case webrtc.PeerConnectionStateClosed:
 			manager.logger.Info().Str("id", id).Msg("peer closed")
+			manager.removePeer(id)
 			manager.sessions.Destroy(id)
 		case webrtc.PeerConnectionStateConnected:
 			manager.logger.Info().Str("id", id).Msg("peer connected")
@@ -200,67 +332,36 @@ func (manager *WebRTCManager) CreatePeer(id string, session types.Session) (stri
 		}
 	})
 
-	if err := session.SetPeer(&Peer{
-		id:            id,
-		api:           api,
-		engine:        &engine,
-		manager:       manager,
-		settings:      &settings,
-		connection:    connection,
-		configuration: configuration,
-	}); err != nil {
-		return "", manager.config.ICELite, manager.config.ICEServers, err
+	if err := session.SetPeer(peer); err != nil {
+		return "", manager.config.ICELite, iceServers, err
 	}
 
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpVideo.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
+	manager.addPeer(peer)
 
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, rtcpErr := rtpAudio.Read(rtcpBuf); rtcpErr != nil {
-				return
-			}
-		}
-	}()
+	go peer.readRTCP("video", rtpVideo)
+	go peer.readRTCP("audio", rtpAudio)
 
-	return description.SDP, manager.config.ICELite, manager.config.ICEServers, nil
+	return description.SDP, manager.config.ICELite, iceServers, nil
 }
 
-func (m *WebRTCManager) createTrack(codecName string) (*webrtc.TrackLocalStaticSample, webrtc.RTPCodecParameters, error) {
-	var codec webrtc.RTPCodecParameters
-
-	fb := []webrtc.RTCPFeedback{}
-
+func codecParameters(codecName string, fb []webrtc.RTCPFeedback) (webrtc.RTPCodecParameters, error) {
 	switch codecName {
 	case "VP8":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 96}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/VP8", ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 96}, nil
 	case "VP9":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/VP9", ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 98}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/VP9", ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 98}, nil
 	case "H264":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/H264", ClockRate: 90000, Channels: 0, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: fb}, PayloadType: 102}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/H264", ClockRate: 90000, Channels: 0, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: fb}, PayloadType: 102}, nil
 	case "Opus":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000, Channels: 2, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 111}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/opus", ClockRate: 48000, Channels: 2, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 111}, nil
 	case "G722":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/G722", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 9}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/G722", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 9}, nil
 	case "PCMU":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/PCMU", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 0}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/PCMU", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 0}, nil
 	case "PCMA":
-		codec = webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/PCMA", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 8}
+		return webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "audio/PCMA", ClockRate: 8000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: fb}, PayloadType: 8}, nil
 	default:
-		return nil, codec, fmt.Errorf("unknown codec %s", codecName)
+		return webrtc.RTPCodecParameters{}, fmt.Errorf("unknown codec %s", codecName)
 	}
-
-	track, err := webrtc.NewTrackLocalStaticSample(codec.RTPCodecCapability, "stream", "stream")
-	if err != nil {
-		return nil, codec, err
-	}
-
-	return track, codec, nil
 }
+